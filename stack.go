@@ -1,7 +1,6 @@
 // Copyright 2016 Chao Wang <hit9@icloud.com>
 
 /*
-
 Package diskstack implements on-disk stack.
 
 Design
@@ -16,13 +15,142 @@ Design
 	| [size   4 bytes] |      |
 	| ...              |      |
 
+# Checksums
+
+When Options.HashAlgo is set to something other than HashNone, the head
+gains a version byte and an algorithm byte in front of the offset/length
+fields, and every record gains a checksum of its data between the data
+and the size field:
+
+	+---------+-------+------------------+------+
+	| version | algo  | [offset 8 bytes] | head |
+	| 1 byte  |1 byte | [length 4 bytes] |  14  |
+	+---------+-------+------------------+------+
+	| [data       X bytes] |                    |
+	| [checksum   N bytes] | body               |
+	| [size       4 bytes] |                    |
+	| ...                  |                    |
+
+Files written before this feature existed have offset 0 holding the
+high byte of the (small) offset field, which is always zero, so Open
+tells the two head formats apart by checking whether that byte is zero.
+Such legacy files keep working unchanged but cannot gain checksums
+in-place; start a fresh file to enable them.
+
+# Encryption
+
+When Options.Cipher is set, the head is promoted once more (version 2)
+to also carry a cipher algorithm byte and a variable-length meta block
+holding a random per-file KDF salt and an authenticated "key check"
+value, so a wrong key is rejected at Open instead of surfacing as
+garbage on the first Pop:
+
+	+---------+------+--------+------------------+------+--------+
+	| version | hash | cipher | [offset 8 bytes] | meta | head   |
+	| 1 byte  |1 byte|1 byte  | [length 4 bytes] | len  |17+len  |
+	+---------+------+--------+------------------+------+--------+
+	| [salt    len 2 bytes][salt]                                |
+	| [keyCheck len 2 bytes][keyCheck]                            |
+	+--------------------------------------------------------------+
+	| [nonce      N bytes] |                                     |
+	| [sealed data+tag   ] | body                                |
+	| [size       4 bytes] |                                     |
+	| ...                  |                                     |
+
+Records are sealed independently with a fresh random nonce, so the
+per-record checksum is redundant and is not written in cipher mode; the
+AEAD tag already authenticates the data.
+
+# Ring mode
+
+When Options.TailDropPolicy is TailDropOldest, the stack becomes a
+bounded ring: once Options.MaxRecords is reached, Put discards the
+oldest record(s) from the bottom instead of growing forever. This needs
+a separate, version-3 head tracking where the live region now starts
+(tailOffset no longer fixed at headSize) and how many records have been
+permanently dropped (itemOffset), and it needs records to carry their
+size on both ends so the bottom can be walked forward without reading
+every byte in between:
+
+	+---------+----------+------------------+------+-------------+-------------+------+
+	| version | reserved | [offset 8 bytes] | head | tailOffset  | itemOffset  | head |
+	| 1 byte  | 1 byte   | [length 4 bytes] |      | 8 bytes     | 8 bytes     |  30  |
+	+---------+----------+------------------+------+-------------+-------------+------+
+	| [size   4 bytes] |                    |
+	| [data   X bytes] | body               |
+	| [size   4 bytes] |                    |
+	| ...               |                   |
+
+Ring mode cannot be combined with Options.HashAlgo or Options.Cipher in
+this version; Open returns ErrRingModeConflict if both are set.
+
+# Storage
+
+Stack does not talk to *os.File directly: every read, write, truncate
+and size check goes through the small Storage interface, and OpenWith
+takes a Storage instead of a path. Open is a thin convenience wrapper
+that opens a plain file and calls OpenWith. Besides the default
+fileStorage, this package ships memStorage, an in-memory backend handy
+for tests that want Stack's on-disk format without touching the
+filesystem, and mmapStorage, which memory-maps the file for fast reads
+on read-heavy workloads.
+
+# Write-ahead log
+
+Put and Pop each write a payload, then overwrite the head so it points
+at the new top; a crash between those two writes leaves the head
+disagreeing with what's actually on disk. When the Storage implements
+WALCapable (fileStorage does; memStorage and mmapStorage don't),
+OpenWith opens a sidecar write-ahead log next to it and every head
+update goes through it first: the intended new offset/length (and, for a
+ring-mode DropOldest/Put/Clear, the new tailOffset/itemOffset too) is
+appended to the WAL as a checksummed intent record, fsynced, only then
+applied to the head, and the WAL is truncated back to empty. On Open,
+a non-empty WAL means the process crashed mid-update: if the intent's
+checksum is intact, its fields are replayed onto the head; if the
+checksum is torn, the intent never finished fsyncing, so the head was
+never touched either, and it is simply discarded.
+
+Ring-mode DropOldest has one more wrinkle: once enough has been dropped
+to cross Options.FragmentsThreshold, it also reclaims the freed space by
+shifting the live region down to headSize, which unlike the other head
+updates moves bytes rather than just a pointer. Writing that shift's WAL
+intent before any bytes move (instead of after, as an ordinary commit
+would) would leave a crash window where the still-untouched head points
+at a tailOffset whose bytes the shift already overwrote; instead the
+intent carries the shift's source offset, and replay redoes the shift
+itself before applying the head, which is safe whether or not the shift
+(and the truncate that reclaims the space) had already completed.
+
+This makes the head consistent across a process crash regardless of
+Options.SyncPolicy, but by itself only assumes the payload write already
+reached the disk, which the WAL's own fsync does not guarantee against a
+real power loss. Options.SyncPolicy closes that gap: before a Put's WAL
+intent is written (and trusted), SyncOnPut fsyncs the main storage so
+that payload is confirmed on disk first, SyncBatch(n) does the same
+every n Puts, and SyncNone (the default) skips this, trading power-loss
+safety of the payload for throughput while keeping the head itself
+crash-consistent. Sync is also exposed directly for explicit checkpoints.
+
+# Iteration
+
+Top shows only the top record, and Pop, the only built-in way to reach
+the records below it, is destructive. Iterator walks records top-to-bottom without removing them, for
+inspection, metrics and recovery tooling. Rather than holding a lock for
+its whole lifetime, an Iterator snapshots the stack's generation counter
+at creation; the counter is bumped by every Put, Pop, Clear and
+DropOldest, and each Next checks it first, returning ErrIterInvalidated
+if the stack moved underneath it instead of risking a torn read. PeekN
+is a convenience wrapper for grabbing up to n records at once.
 */
 package diskstack
 
 import (
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
-	"os"
+	"hash/crc32"
 	"sync"
 )
 
@@ -35,9 +163,22 @@ const (
 
 // Head size
 const (
-	offsetSize = 8
-	lengthSize = 4
-	headSize   = offsetSize + lengthSize
+	offsetSize     = 8
+	lengthSize     = 4
+	legacyHeadSize = offsetSize + lengthSize
+	newHeadSize    = 2 + offsetSize + lengthSize // version + algo + offset + length
+
+	headVersionHash   = 1 // hash-only head: version,hashAlgo,offset,length
+	headVersionCipher = 2 // hash+cipher head: adds cipherAlgo and a meta block
+	headVersionRing   = 3 // ring head: adds tailOffset and itemOffset
+
+	// cipherHeadBase is the fixed-size portion of a version-2 head:
+	// version,hashAlgo,cipherAlgo,offset,length,metaLen.
+	cipherHeadBase = 1 + 1 + 1 + offsetSize + lengthSize + 2
+
+	// ringHeadSize is the size of a version-3 head:
+	// version,reserved,offset,length,tailOffset,itemOffset.
+	ringHeadSize = 1 + 1 + offsetSize + lengthSize + offsetSize + offsetSize
 )
 
 // Default options.
@@ -46,10 +187,118 @@ const (
 	DefaultSizeLimit          int64 = 16 * GB
 )
 
+// HashAlgo identifies the per-record checksum algorithm used to detect
+// bitrot.
+type HashAlgo uint8
+
+// Supported hash algorithms.
+const (
+	HashNone   HashAlgo = iota // no per-record checksum
+	HashCRC32C                 // 4-byte CRC32 with the Castagnoli polynomial
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CipherAlgo identifies the per-record encryption scheme.
+type CipherAlgo uint8
+
+// Supported cipher algorithms.
+const (
+	CipherNone CipherAlgo = iota // records are stored in plaintext
+	CipherAEAD                   // records are sealed with a caller-supplied cipher.AEAD
+)
+
+// cipherSaltSize is the size of the random per-file salt generated for
+// newly created encrypted files.
+const cipherSaltSize = 16
+
+// keyCheckPlaintext is sealed with a fixed nonce and stored in the head
+// of an encrypted file so a wrong key is rejected at Open time.
+var keyCheckPlaintext = []byte("diskstack-key-check")
+
+// TailDropPolicy controls what Put does once Options.MaxRecords is
+// reached.
+type TailDropPolicy uint8
+
+// Supported tail-drop policies.
+const (
+	// TailDropDisabled means Put returns ErrSizeLimit once MaxRecords is
+	// reached.
+	TailDropDisabled TailDropPolicy = iota
+	// TailDropOldest means Put discards the oldest record(s) from the
+	// bottom of the stack to make room instead of failing, turning the
+	// stack into a bounded ring buffer.
+	TailDropOldest
+)
+
+// SyncPolicy controls how often Put fsyncs main storage before trusting
+// the payload it just wrote. The write-ahead log guarantees the head
+// never disagrees with what's on disk across a process crash regardless
+// of SyncPolicy, but that guarantee is only as good as the assumption
+// that the payload write already reached the disk; SyncPolicy trades
+// throughput against closing that last gap for a real power loss. The
+// zero value is SyncNone.
+type SyncPolicy struct {
+	onPut  bool
+	everyN int
+}
+
+// SyncNone never fsyncs automatically; callers that need durability
+// checkpoints must call Sync themselves.
+var SyncNone = SyncPolicy{}
+
+// SyncOnPut fsyncs after every Put.
+var SyncOnPut = SyncPolicy{onPut: true}
+
+// SyncBatch fsyncs after every n Puts.
+func SyncBatch(n int) SyncPolicy {
+	return SyncPolicy{everyN: n}
+}
+
+// shouldSync reports whether putCount (the number of Puts since Open;
+// syncs do not reset it) warrants an automatic fsync under p.
+func (p SyncPolicy) shouldSync(putCount int) bool {
+	if p.onPut {
+		return true
+	}
+	return p.everyN > 0 && putCount%p.everyN == 0
+}
+
+// WAL intent records.
+const (
+	// walOpCommit: op,reserved,newOffset,newLength,crc. Used by every
+	// head update that leaves tailOffset/itemOffset unchanged: Put, Pop
+	// and Clear outside ring mode, and Pop and a Put that drops nothing
+	// in ring mode.
+	walOpCommit = 1
+	// walOpCommitRing: op,reserved,newOffset,newLength,newTailOffset,
+	// newItemOffset,crc. Used by a ring-mode Put that drops records,
+	// DropOldest and ring-mode Clear, which also move the bottom of the
+	// live region.
+	walOpCommitRing = 2
+	// walOpCompactRing: op,reserved,newOffset,newLength,newItemOffset,
+	// oldTailOffset,crc. Used when DropOldest crosses
+	// Options.FragmentsThreshold and reclaims the dropped space by
+	// shifting the live region down to headSize. Unlike walOpCommitRing,
+	// the intent alone doesn't make the update visible: the shift itself
+	// is the payload here, so replay must be able to redo it, not just
+	// trust it happened, hence the separate op and oldTailOffset field.
+	walOpCompactRing = 3
+
+	walRecordSize        = 1 + 1 + offsetSize + lengthSize + 4
+	ringWalRecordSize    = 1 + 1 + offsetSize + lengthSize + offsetSize + offsetSize + 4
+	compactWalRecordSize = 1 + 1 + offsetSize + lengthSize + offsetSize + offsetSize + 4
+)
+
 // Errors
 var (
-	ErrSizeLimit   = errors.New("diskstack: size limit")
-	ErrFileInvalid = errors.New("diskstack: invalid file")
+	ErrSizeLimit        = errors.New("diskstack: size limit")
+	ErrFileInvalid      = errors.New("diskstack: invalid file")
+	ErrChecksumMismatch = errors.New("diskstack: checksum mismatch")
+	ErrAuthFailed       = errors.New("diskstack: authentication failed")
+	ErrRingModeConflict = errors.New("diskstack: ring mode cannot be combined with HashAlgo or Cipher")
+	ErrRingModeRequired = errors.New("diskstack: this operation requires ring mode (TailDropPolicy: TailDropOldest)")
+	ErrIterInvalidated  = errors.New("diskstack: iterator invalidated by a concurrent Put, Pop, Clear or DropOldest")
 )
 
 // Options is the options to open Stack.
@@ -61,24 +310,100 @@ type Options struct {
 	// ErrSizeLimit if the file size is greater than this value.
 	// Negative number means no size limitation.
 	SizeLimit int64
+	// HashAlgo selects the per-record checksum algorithm used to detect
+	// bitrot. Defaults to HashNone. Only takes effect on newly created
+	// files; it is ignored when reopening an existing legacy file.
+	HashAlgo HashAlgo
+	// Cipher, if set, enables per-record authenticated encryption: every
+	// record is sealed independently with a fresh random nonce using the
+	// given AEAD (e.g. AES-GCM from crypto/cipher or ChaCha20-Poly1305
+	// from golang.org/x/crypto/chacha20poly1305). The caller is
+	// responsible for deriving and protecting the key; (*Stack).CipherSalt
+	// returns the random per-file salt stored in the head, which the
+	// caller's KDF can use to bind a key to this file. A wrong key is
+	// rejected at Open with ErrAuthFailed.
+	Cipher cipher.AEAD
+	// MaxRecords, if non-zero, bounds how many records the stack
+	// retains. What Put does once the bound is reached is controlled by
+	// TailDropPolicy.
+	MaxRecords int
+	// TailDropPolicy selects the behavior once MaxRecords is reached.
+	// Defaults to TailDropDisabled. TailDropOldest cannot be combined
+	// with HashAlgo or Cipher in this version.
+	TailDropPolicy TailDropPolicy
+	// SyncPolicy controls how often Put fsyncs to stable storage.
+	// Defaults to SyncNone. It applies to every Storage backend, with or
+	// without a write-ahead log (see WALCapable): the fsync is the
+	// Storage's own Sync, which for memStorage does nothing.
+	SyncPolicy SyncPolicy
+}
+
+// checksumSize returns the number of trailing checksum bytes a record
+// written with the given algorithm carries.
+func checksumSize(algo HashAlgo) int64 {
+	switch algo {
+	case HashCRC32C:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// computeChecksum computes the checksum of data using the given algorithm.
+func computeChecksum(algo HashAlgo, data []byte) uint32 {
+	switch algo {
+	case HashCRC32C:
+		return crc32.Checksum(data, crc32cTable)
+	default:
+		return 0
+	}
 }
 
 // Stack is the disk-based stack abstraction.
 type Stack struct {
-	file   *os.File     // os file handle
-	offset int64        // top offset (real offset is 8+4+offset)
-	frags  int64        // fragments size
-	length int          // length of stack
-	lock   sync.RWMutex // protects offset,frags,length
-	opts   *Options
+	storage  Storage      // storage backend
+	offset   int64        // top offset (real offset is headSize+offset)
+	frags    int64        // fragments size
+	length   int          // length of stack
+	lock     sync.RWMutex // protects offset,frags,length
+	opts     *Options
+	headSize int64    // size of the head block
+	algo     HashAlgo // per-record checksum algorithm in effect for this file
+
+	cipherAlgo     CipherAlgo  // per-record encryption algorithm in effect for this file
+	aead           cipher.AEAD // set when cipherAlgo is CipherAEAD
+	cipherSalt     []byte      // random per-file salt, stored in the head
+	cipherKeyCheck []byte      // sealed keyCheckPlaintext, stored in the head
+
+	ringMode       bool           // true when opened with TailDropPolicy: TailDropOldest
+	maxRecords     int            // Options.MaxRecords, 0 means unlimited
+	tailDropPolicy TailDropPolicy // Options.TailDropPolicy
+	tailOffset     int64          // bottom of the live region; headSize unless ring mode dropped records
+	itemOffset     int64          // number of records permanently dropped from the bottom
+
+	wal      Storage // write-ahead log sidecar, nil if storage doesn't support one
+	putCount int     // Puts since Open (never reset by Sync), for SyncPolicy.everyN
+
+	gen int64 // bumped on every Put, Pop, Clear or DropOldest; invalidates Iterators
 }
 
 // Open opens or creates a Stack for given path, will create if not exist.
+// It is a convenience wrapper around OpenWith using the default file-based
+// Storage.
 func Open(path string, opts *Options) (s *Stack, err error) {
-	// Open or create the file.
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	storage, err := newFileStorage(path)
 	if err != nil {
-		return
+		return nil, err
+	}
+	return OpenWith(storage, opts)
+}
+
+// OpenWith opens or creates a Stack on top of the given Storage. This is
+// the general form of Open, for callers that want a Storage backend
+// other than a plain file, e.g. memStorage or mmapStorage.
+func OpenWith(storage Storage, opts *Options) (s *Stack, err error) {
+	if opts != nil && opts.TailDropPolicy == TailDropOldest && (opts.HashAlgo != HashNone || opts.Cipher != nil) {
+		return nil, ErrRingModeConflict
 	}
 	// Create Stack.
 	options := &Options{
@@ -92,40 +417,160 @@ func Open(path string, opts *Options) (s *Stack, err error) {
 		if opts.SizeLimit != 0 {
 			options.SizeLimit = opts.SizeLimit
 		}
+		options.HashAlgo = opts.HashAlgo
+		options.Cipher = opts.Cipher
+		options.MaxRecords = opts.MaxRecords
+		options.TailDropPolicy = opts.TailDropPolicy
+		options.SyncPolicy = opts.SyncPolicy
+	}
+	s = &Stack{opts: options, storage: storage}
+	if options.Cipher != nil {
+		s.cipherAlgo = CipherAEAD
+		s.aead = options.Cipher
+	}
+	s.maxRecords = options.MaxRecords
+	s.tailDropPolicy = options.TailDropPolicy
+	s.ringMode = options.TailDropPolicy == TailDropOldest
+	if wc, ok := storage.(WALCapable); ok {
+		if s.wal, err = wc.OpenWAL(); err != nil {
+			return
+		}
 	}
-	s = &Stack{opts: options, file: file}
-	// Get file size.
-	info, err := file.Stat()
+	// Get storage size.
+	fileSize, err := storage.Size()
 	if err != nil {
 		return
 	}
-	fileSize := info.Size()
-	if fileSize < headSize {
+	if fileSize < legacyHeadSize {
 		if fileSize != 0 {
 			err = ErrFileInvalid // invalid small file
 			return
 		}
-		if err = s.file.Truncate(0); err != nil {
+		if err = s.storage.Truncate(0); err != nil {
 			// Force truncate the file to be empty.
 			return
 		}
-		s.offset = headSize
+		if s.wal != nil {
+			// Any WAL left over belongs to a previous incarnation of
+			// this path, not to the file we just created; discard it.
+			if err = s.wal.Truncate(0); err != nil {
+				return
+			}
+		}
+		s.algo = options.HashAlgo
+		if s.ringMode {
+			s.headSize = ringHeadSize
+			s.offset = s.headSize
+			s.tailOffset = s.headSize
+			s.length = 0
+			s.itemOffset = 0
+			err = s.writeHead()
+			return
+		}
+		if s.cipherAlgo != CipherNone {
+			if s.cipherSalt, err = randomBytes(cipherSaltSize); err != nil {
+				return
+			}
+			if s.cipherKeyCheck, err = s.sealKeyCheck(); err != nil {
+				return
+			}
+			meta := cipherMeta(s.cipherSalt, s.cipherKeyCheck)
+			s.headSize = cipherHeadBase + int64(len(meta))
+			s.offset = s.headSize
+			s.tailOffset = s.headSize
+			s.length = 0
+			err = s.writeHead()
+			return
+		}
+		if s.algo != HashNone {
+			s.headSize = newHeadSize
+		} else {
+			s.headSize = legacyHeadSize
+		}
+		s.offset = s.headSize
+		s.tailOffset = s.headSize
 		s.length = 0
 		err = s.writeHead()
 		return
 	}
-	// Read offset.
-	b := make([]byte, offsetSize)
-	if _, err = file.ReadAt(b, 0); err != nil {
+	// The first byte is the high byte of the legacy offset field, which is
+	// always zero for any file smaller than 2^56 bytes; a new-format head
+	// sets it to a non-zero version instead, so it doubles as a marker.
+	vb := make([]byte, 1)
+	if _, err = storage.ReadAt(vb, 0); err != nil {
 		return
 	}
-	s.offset = int64(binary.BigEndian.Uint64(b))
-	// Read length.
-	b = make([]byte, 4)
-	if _, err = file.ReadAt(b, offsetSize); err != nil {
+	switch {
+	case vb[0] == 0:
+		s.headSize = legacyHeadSize
+		s.algo = HashNone
+		s.cipherAlgo = CipherNone
+		// Read offset.
+		b := make([]byte, offsetSize)
+		if _, err = storage.ReadAt(b, 0); err != nil {
+			return
+		}
+		s.offset = int64(binary.BigEndian.Uint64(b))
+		// Read length.
+		b = make([]byte, lengthSize)
+		if _, err = storage.ReadAt(b, offsetSize); err != nil {
+			return
+		}
+		s.length = int(binary.BigEndian.Uint32(b))
+		s.tailOffset = s.headSize
+	case vb[0] == headVersionHash:
+		if fileSize < newHeadSize {
+			err = ErrFileInvalid
+			return
+		}
+		s.headSize = newHeadSize
+		s.cipherAlgo = CipherNone
+		ab := make([]byte, 1)
+		if _, err = storage.ReadAt(ab, 1); err != nil {
+			return
+		}
+		s.algo = HashAlgo(ab[0])
+		b := make([]byte, offsetSize)
+		if _, err = storage.ReadAt(b, 2); err != nil {
+			return
+		}
+		s.offset = int64(binary.BigEndian.Uint64(b))
+		b = make([]byte, lengthSize)
+		if _, err = storage.ReadAt(b, 2+offsetSize); err != nil {
+			return
+		}
+		s.length = int(binary.BigEndian.Uint32(b))
+		s.tailOffset = s.headSize
+	case vb[0] == headVersionCipher:
+		if fileSize < cipherHeadBase {
+			err = ErrFileInvalid
+			return
+		}
+		if err = s.readCipherHead(fileSize); err != nil {
+			return
+		}
+		if s.aead == nil {
+			err = ErrAuthFailed // no cipher configured to open an encrypted file
+			return
+		}
+		s.tailOffset = s.headSize
+	case vb[0] == headVersionRing:
+		if fileSize < ringHeadSize {
+			err = ErrFileInvalid
+			return
+		}
+		s.headSize = ringHeadSize
+		s.ringMode = true
+		if err = s.readRingHead(); err != nil {
+			return
+		}
+	default:
+		err = ErrFileInvalid
+		return
+	}
+	if err = s.replayWAL(); err != nil {
 		return
 	}
-	s.length = int(binary.BigEndian.Uint32(b))
 	// Frags
 	if err = s.truncate(); err != nil { // Remove the fragements
 		return
@@ -134,41 +579,268 @@ func Open(path string, opts *Options) (s *Stack, err error) {
 	return s, nil
 }
 
+// randomBytes returns n cryptographically random bytes.
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// cipherMeta packs salt and keyCheck into the variable-length meta block
+// stored right after the fixed part of a version-2 head.
+func cipherMeta(salt, keyCheck []byte) []byte {
+	meta := make([]byte, 2+len(salt)+2+len(keyCheck))
+	binary.BigEndian.PutUint16(meta, uint16(len(salt)))
+	copy(meta[2:], salt)
+	binary.BigEndian.PutUint16(meta[2+len(salt):], uint16(len(keyCheck)))
+	copy(meta[2+len(salt)+2:], keyCheck)
+	return meta
+}
+
+// keyCheckNonce is the fixed nonce used only for the head's key-check
+// value, which is sealed once per file and never reused for record data.
+func (s *Stack) keyCheckNonce() []byte {
+	return make([]byte, s.aead.NonceSize())
+}
+
+// sealKeyCheck seals keyCheckPlaintext so a future Open can detect a
+// wrong key without touching any stack data.
+func (s *Stack) sealKeyCheck() ([]byte, error) {
+	return s.aead.Seal(nil, s.keyCheckNonce(), keyCheckPlaintext, nil), nil
+}
+
+// writeCipherHead writes a version-2 (hash+cipher) head with the given
+// pre-built meta block.
+func (s *Stack) writeCipherHead(meta []byte) error {
+	b := make([]byte, cipherHeadBase+len(meta))
+	b[0] = headVersionCipher
+	b[1] = byte(s.algo)
+	b[2] = byte(s.cipherAlgo)
+	binary.BigEndian.PutUint64(b[3:], uint64(s.offset))
+	binary.BigEndian.PutUint32(b[3+offsetSize:], uint32(s.length))
+	binary.BigEndian.PutUint16(b[3+offsetSize+lengthSize:], uint16(len(meta)))
+	copy(b[cipherHeadBase:], meta)
+	_, err := s.storage.WriteAt(b, 0)
+	return err
+}
+
+// readCipherHead reads a version-2 head, validating the configured
+// cipher against the stored key-check value.
+func (s *Stack) readCipherHead(fileSize int64) (err error) {
+	s.cipherAlgo = CipherAEAD
+	b := make([]byte, cipherHeadBase)
+	if _, err = s.storage.ReadAt(b, 0); err != nil {
+		return
+	}
+	s.algo = HashAlgo(b[1])
+	s.offset = int64(binary.BigEndian.Uint64(b[3:]))
+	s.length = int(binary.BigEndian.Uint32(b[3+offsetSize:]))
+	metaLen := int64(binary.BigEndian.Uint16(b[3+offsetSize+lengthSize:]))
+	s.headSize = cipherHeadBase + metaLen
+	if fileSize < s.headSize {
+		return ErrFileInvalid
+	}
+	meta := make([]byte, metaLen)
+	if _, err = s.storage.ReadAt(meta, cipherHeadBase); err != nil {
+		return
+	}
+	saltLen := int(binary.BigEndian.Uint16(meta))
+	s.cipherSalt = meta[2 : 2+saltLen]
+	keyCheckLen := int(binary.BigEndian.Uint16(meta[2+saltLen:]))
+	s.cipherKeyCheck = meta[2+saltLen+2 : 2+saltLen+2+keyCheckLen]
+	if s.aead == nil {
+		return // no cipher configured; caller rejects this below
+	}
+	if _, err = s.aead.Open(nil, s.keyCheckNonce(), s.cipherKeyCheck, nil); err != nil {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// CipherSalt returns the random per-file salt stored in the head of an
+// encrypted stack, or nil if the stack is not encrypted. Callers can feed
+// this into their own KDF to bind a derived key to this specific file.
+func (s *Stack) CipherSalt() []byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cipherSalt
+}
+
 // Put an item onto the Stack.
 func (s *Stack) Put(data []byte) (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	if s.ringMode {
+		return s.putRing(data)
+	}
 	if s.opts.SizeLimit > 0 && s.offset >= s.opts.SizeLimit {
 		return ErrSizeLimit
 	}
-	buf := make([]byte, len(data)+4)
-	copy(buf, data)                                                // data
-	binary.BigEndian.PutUint32(buf[len(data):], uint32(len(data))) // size
-	if _, err = s.file.WriteAt(buf, s.offset); err != nil {
+	if s.maxRecords > 0 && s.length >= s.maxRecords {
+		return ErrSizeLimit
+	}
+	var buf []byte
+	if s.cipherAlgo != CipherNone {
+		if buf, err = s.sealRecord(data); err != nil {
+			return
+		}
+	} else {
+		csSize := checksumSize(s.algo)
+		buf = make([]byte, int64(len(data))+csSize+4)
+		copy(buf, data) // data
+		if csSize > 0 {
+			binary.BigEndian.PutUint32(buf[len(data):], computeChecksum(s.algo, data)) // checksum
+		}
+		binary.BigEndian.PutUint32(buf[int64(len(data))+csSize:], uint32(len(data))) // size
+	}
+	if _, err = s.storage.WriteAt(buf, s.offset); err != nil {
 		return
 	}
-	s.offset += int64(len(buf))
 	if s.frags > int64(len(buf)) {
 		s.frags -= int64(len(buf))
 	}
-	s.length++
-	return s.writeHead()
+	if err = s.syncPayload(); err != nil {
+		return
+	}
+	return s.commitHead(s.offset+int64(len(buf)), s.length+1)
+}
+
+// putRing appends data as a ring-mode record, which carries its size on
+// both ends so the bottom can be walked forward, then drops the oldest
+// record(s) if MaxRecords was exceeded.
+func (s *Stack) putRing(data []byte) (err error) {
+	if s.opts.SizeLimit > 0 && s.offset >= s.opts.SizeLimit {
+		return ErrSizeLimit
+	}
+	buf := make([]byte, 4+len(data)+4)
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	binary.BigEndian.PutUint32(buf[4+len(data):], uint32(len(data)))
+	if _, err = s.storage.WriteAt(buf, s.offset); err != nil {
+		return
+	}
+	if err = s.syncPayload(); err != nil {
+		return
+	}
+	newOffset := s.offset + int64(len(buf))
+	newLength := s.length + 1
+	if s.maxRecords > 0 && newLength > s.maxRecords {
+		s.offset = newOffset
+		s.length = newLength
+		return s.dropOldestLocked(newLength - s.maxRecords)
+	}
+	return s.commitHead(newOffset, newLength)
+}
+
+// syncPayload fsyncs the payload Put or putRing just wrote to main
+// storage, when Options.SyncPolicy calls for it. This must run before
+// commitHead stages a WAL intent referencing that payload: the WAL's
+// fsync only makes the intent itself durable, and replaying a trusted
+// intent onto the head is only safe if the payload it points at is
+// already on disk. Under SyncNone (the default) this is a no-op, so the
+// WAL still makes the head crash-consistent across a process crash, but
+// a real power-loss between the payload write and the OS's own flush
+// can still replay the head past a payload that never made it to disk;
+// SyncOnPut and SyncBatch close that gap at the cost of an extra fsync
+// per Put (or per n Puts). Caller must hold s.lock.
+func (s *Stack) syncPayload() error {
+	s.putCount++
+	if !s.opts.SyncPolicy.shouldSync(s.putCount) {
+		return nil
+	}
+	return s.storage.Sync()
+}
+
+// sealRecord encrypts data into a [nonce][sealed][size] on-disk record,
+// where size is the length of the sealed (ciphertext+tag) portion.
+func (s *Stack) sealRecord(data []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	nonce, err := randomBytes(nonceSize)
+	if err != nil {
+		return nil, err
+	}
+	sealed := s.aead.Seal(nil, nonce, data, nil)
+	buf := make([]byte, nonceSize+len(sealed)+4)
+	copy(buf, nonce)
+	copy(buf[nonceSize:], sealed)
+	binary.BigEndian.PutUint32(buf[nonceSize+len(sealed):], uint32(len(sealed)))
+	return buf, nil
 }
 
 // top returns the top item.
 func (s *Stack) top() (data []byte, err error) {
-	if s.offset < headSize+4 {
-		return nil, nil
+	data, _, err = s.recordAt(s.offset)
+	return
+}
+
+// recordAt decodes the record ending at the on-disk offset at, returning
+// its plaintext data and the total number of bytes it occupies on disk.
+func (s *Stack) recordAt(at int64) (data []byte, recSize int64, err error) {
+	if at < s.tailOffset+4 {
+		return nil, 0, nil
+	}
+	if s.cipherAlgo != CipherNone {
+		return s.cipherRecordAt(at)
 	}
+	csSize := checksumSize(s.algo)
 	b := make([]byte, 4)
-	if _, err = s.file.ReadAt(b, s.offset-4); err != nil { // size
+	if _, err = s.storage.ReadAt(b, at-4); err != nil { // size
 		return
 	}
 	size := binary.BigEndian.Uint32(b)
+	dataOffset := at - 4 - csSize - int64(size)
+	recStart := dataOffset
+	if s.ringMode {
+		recStart -= 4 // leading size field, duplicated so the tail can walk forward
+	}
+	if recStart < s.tailOffset {
+		return nil, 0, ErrFileInvalid
+	}
+	recSize = at - recStart
 	data = make([]byte, size)
-	if _, err = s.file.ReadAt(data, s.offset-4-int64(size)); err != nil { // data
+	if _, err = s.storage.ReadAt(data, dataOffset); err != nil { // data
 		return
 	}
+	if csSize > 0 {
+		cb := make([]byte, csSize)
+		if _, err = s.storage.ReadAt(cb, dataOffset+int64(size)); err != nil { // checksum
+			return
+		}
+		if computeChecksum(s.algo, data) != binary.BigEndian.Uint32(cb) {
+			return nil, recSize, ErrChecksumMismatch
+		}
+	}
+	return
+}
+
+// cipherRecordAt decodes the encrypted record ending at the on-disk
+// offset at, returning its decrypted data and the total on-disk size.
+func (s *Stack) cipherRecordAt(at int64) (data []byte, recSize int64, err error) {
+	b := make([]byte, 4)
+	if _, err = s.storage.ReadAt(b, at-4); err != nil { // size (= sealed length)
+		return
+	}
+	sealedSize := int64(binary.BigEndian.Uint32(b))
+	nonceSize := int64(s.aead.NonceSize())
+	sealedOffset := at - 4 - sealedSize
+	nonceOffset := sealedOffset - nonceSize
+	recSize = nonceSize + sealedSize + 4
+	if nonceOffset < s.tailOffset {
+		return nil, recSize, ErrFileInvalid
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err = s.storage.ReadAt(nonce, nonceOffset); err != nil {
+		return
+	}
+	sealed := make([]byte, sealedSize)
+	if _, err = s.storage.ReadAt(sealed, sealedOffset); err != nil {
+		return
+	}
+	if data, err = s.aead.Open(nil, nonce, sealed, nil); err != nil {
+		return nil, recSize, ErrAuthFailed
+	}
 	return
 }
 
@@ -190,18 +862,17 @@ func (s *Stack) Len() int {
 func (s *Stack) Pop() (data []byte, err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if data, err = s.top(); err != nil {
+	var recSize int64
+	if data, recSize, err = s.recordAt(s.offset); err != nil {
 		return
 	}
 	if data == nil {
 		return // Do nothing on stack empty.
 	}
-	s.offset -= int64(len(data)) + 4
-	s.length--
-	s.frags += int64(len(data)) + 4
-	if err = s.writeHead(); err != nil {
+	if err = s.commitHead(s.offset-recSize, s.length-1); err != nil {
 		return
 	}
+	s.frags += recSize
 	if err = s.compact(); err != nil {
 		return
 	}
@@ -212,10 +883,13 @@ func (s *Stack) Pop() (data []byte, err error) {
 func (s *Stack) Clear() (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.frags = s.offset - 8 - 4
-	s.offset = 8 + 4
-	s.length = 0
-	if err = s.writeHead(); err != nil {
+	s.frags = s.offset - s.headSize
+	if s.ringMode {
+		err = s.commitHeadRing(s.headSize, s.headSize, 0, 0)
+	} else {
+		err = s.commitHead(s.headSize, 0)
+	}
+	if err != nil {
 		return
 	}
 	return s.truncate()
@@ -225,7 +899,7 @@ func (s *Stack) Clear() (err error) {
 func (s *Stack) Close() (err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if err = s.file.Close(); err != nil {
+	if err = s.storage.Close(); err != nil {
 		return
 	}
 	return
@@ -245,16 +919,516 @@ func (s *Stack) truncate() (err error) {
 		// Important: truncate with large size cause unexcepted no-space left error!
 		return ErrSizeLimit
 	}
-	return s.file.Truncate(s.offset)
+	return s.storage.Truncate(s.offset)
+}
+
+// commitHead durably updates s.offset and s.length to the given values
+// and writes the head to reflect them. If the storage has a WAL, the
+// update is staged there and fsynced before the head itself is
+// touched, so a crash between the payload write and the head write is
+// recoverable on the next Open via replayWAL. Outside ring mode this is
+// the only kind of head update there is; ring mode additionally has
+// commitHeadRing for updates that also move tailOffset/itemOffset.
+func (s *Stack) commitHead(newOffset int64, newLength int) error {
+	if s.wal != nil {
+		if err := s.writeWALIntent(newOffset, newLength); err != nil {
+			return err
+		}
+	}
+	s.offset = newOffset
+	s.length = newLength
+	s.gen++
+	if err := s.writeHead(); err != nil {
+		return err
+	}
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Truncate(0)
+}
+
+// commitHeadRing is commitHead's ring-mode counterpart, for the head
+// updates made by a ring-mode Put that drops records, DropOldest and
+// ring-mode Clear, which move
+// tailOffset/itemOffset alongside offset/length and so need those
+// carried in the WAL intent too.
+func (s *Stack) commitHeadRing(newOffset, newTailOffset int64, newLength int, newItemOffset int64) error {
+	if s.wal != nil {
+		if err := s.writeWALIntentRing(newOffset, newTailOffset, newLength, newItemOffset); err != nil {
+			return err
+		}
+	}
+	s.offset = newOffset
+	s.length = newLength
+	s.tailOffset = newTailOffset
+	s.itemOffset = newItemOffset
+	s.gen++
+	if err := s.writeHead(); err != nil {
+		return err
+	}
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Truncate(0)
+}
+
+// writeWALIntent appends a commit intent to the WAL describing the head
+// update about to be applied, and fsyncs it so the intent is durable
+// before the head itself is touched.
+func (s *Stack) writeWALIntent(newOffset int64, newLength int) error {
+	b := make([]byte, walRecordSize)
+	b[0] = walOpCommit
+	binary.BigEndian.PutUint64(b[2:], uint64(newOffset))
+	binary.BigEndian.PutUint32(b[2+offsetSize:], uint32(newLength))
+	binary.BigEndian.PutUint32(b[2+offsetSize+lengthSize:], crc32.Checksum(b[:2+offsetSize+lengthSize], crc32cTable))
+	if _, err := s.wal.WriteAt(b, 0); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// writeWALIntentRing appends a ring-mode commit intent to the WAL,
+// carrying tailOffset/itemOffset alongside offset/length, and fsyncs it
+// so the intent is durable before the head itself is touched.
+func (s *Stack) writeWALIntentRing(newOffset, newTailOffset int64, newLength int, newItemOffset int64) error {
+	b := make([]byte, ringWalRecordSize)
+	b[0] = walOpCommitRing
+	binary.BigEndian.PutUint64(b[2:], uint64(newOffset))
+	binary.BigEndian.PutUint32(b[2+offsetSize:], uint32(newLength))
+	binary.BigEndian.PutUint64(b[2+offsetSize+lengthSize:], uint64(newTailOffset))
+	binary.BigEndian.PutUint64(b[2+offsetSize+lengthSize+offsetSize:], uint64(newItemOffset))
+	crcOff := 2 + offsetSize + lengthSize + offsetSize + offsetSize
+	binary.BigEndian.PutUint32(b[crcOff:], crc32.Checksum(b[:crcOff], crc32cTable))
+	if _, err := s.wal.WriteAt(b, 0); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// writeWALIntentCompactRing appends a compaction intent to the WAL,
+// carrying oldTailOffset (the shift's source) alongside the post-shift
+// offset/length/itemOffset, and fsyncs it so the intent is durable
+// before any bytes are shifted.
+func (s *Stack) writeWALIntentCompactRing(newOffset int64, newLength int, newItemOffset, oldTailOffset int64) error {
+	b := make([]byte, compactWalRecordSize)
+	b[0] = walOpCompactRing
+	binary.BigEndian.PutUint64(b[2:], uint64(newOffset))
+	binary.BigEndian.PutUint32(b[2+offsetSize:], uint32(newLength))
+	binary.BigEndian.PutUint64(b[2+offsetSize+lengthSize:], uint64(newItemOffset))
+	binary.BigEndian.PutUint64(b[2+offsetSize+lengthSize+offsetSize:], uint64(oldTailOffset))
+	crcOff := 2 + offsetSize + lengthSize + offsetSize + offsetSize
+	binary.BigEndian.PutUint32(b[crcOff:], crc32.Checksum(b[:crcOff], crc32cTable))
+	if _, err := s.wal.WriteAt(b, 0); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// replayWAL recovers a pending commit intent from the write-ahead log,
+// if any, bringing the head-related fields back in sync with the last
+// payload write that completed before a crash. A no-op when s.wal is
+// nil (the storage doesn't support a WAL) or empty (nothing pending).
+func (s *Stack) replayWAL() error {
+	if s.wal == nil {
+		return nil
+	}
+	size, err := s.wal.Size()
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	op := make([]byte, 1)
+	if _, err = s.wal.ReadAt(op, 0); err != nil {
+		return err
+	}
+	switch op[0] {
+	case walOpCommit:
+		return s.replayWALCommit(size)
+	case walOpCommitRing:
+		return s.replayWALCommitRing(size)
+	case walOpCompactRing:
+		return s.replayWALCompactRing(size)
+	default:
+		// Unrecognized op byte: the write that would make this intent
+		// trustworthy never finished fsyncing, so the head was never
+		// touched either. Discard it and trust the head as read.
+		return s.wal.Truncate(0)
+	}
+}
+
+// replayWALCommit replays a walOpCommit intent, or discards it if it's
+// torn (too short or a bad checksum).
+func (s *Stack) replayWALCommit(size int64) error {
+	if size < walRecordSize {
+		return s.wal.Truncate(0)
+	}
+	b := make([]byte, walRecordSize)
+	if _, err := s.wal.ReadAt(b, 0); err != nil {
+		return err
+	}
+	crc := binary.BigEndian.Uint32(b[2+offsetSize+lengthSize:])
+	if b[0] != walOpCommit || crc32.Checksum(b[:2+offsetSize+lengthSize], crc32cTable) != crc {
+		return s.wal.Truncate(0)
+	}
+	s.offset = int64(binary.BigEndian.Uint64(b[2:]))
+	s.length = int(binary.BigEndian.Uint32(b[2+offsetSize:]))
+	if err := s.writeHead(); err != nil {
+		return err
+	}
+	return s.wal.Truncate(0)
+}
+
+// replayWALCommitRing replays a walOpCommitRing intent, or discards it
+// if it's torn (too short or a bad checksum).
+func (s *Stack) replayWALCommitRing(size int64) error {
+	if size < ringWalRecordSize {
+		return s.wal.Truncate(0)
+	}
+	b := make([]byte, ringWalRecordSize)
+	if _, err := s.wal.ReadAt(b, 0); err != nil {
+		return err
+	}
+	crcOff := 2 + offsetSize + lengthSize + offsetSize + offsetSize
+	crc := binary.BigEndian.Uint32(b[crcOff:])
+	if b[0] != walOpCommitRing || crc32.Checksum(b[:crcOff], crc32cTable) != crc {
+		return s.wal.Truncate(0)
+	}
+	s.offset = int64(binary.BigEndian.Uint64(b[2:]))
+	s.length = int(binary.BigEndian.Uint32(b[2+offsetSize:]))
+	s.tailOffset = int64(binary.BigEndian.Uint64(b[2+offsetSize+lengthSize:]))
+	s.itemOffset = int64(binary.BigEndian.Uint64(b[2+offsetSize+lengthSize+offsetSize:]))
+	if err := s.writeHead(); err != nil {
+		return err
+	}
+	return s.wal.Truncate(0)
+}
+
+// replayWALCompactRing replays a walOpCompactRing intent, or discards it
+// if it's torn (too short or a bad checksum). Unlike the other replay
+// functions, the intent alone doesn't describe a completed update: it
+// redoes the live-region shift via shiftLiveRegion (a no-op if the shift
+// and its truncate already ran before the crash) before applying the
+// head and reclaiming the space.
+func (s *Stack) replayWALCompactRing(size int64) error {
+	if size < compactWalRecordSize {
+		return s.wal.Truncate(0)
+	}
+	b := make([]byte, compactWalRecordSize)
+	if _, err := s.wal.ReadAt(b, 0); err != nil {
+		return err
+	}
+	crcOff := 2 + offsetSize + lengthSize + offsetSize + offsetSize
+	crc := binary.BigEndian.Uint32(b[crcOff:])
+	if b[0] != walOpCompactRing || crc32.Checksum(b[:crcOff], crc32cTable) != crc {
+		return s.wal.Truncate(0)
+	}
+	newOffset := int64(binary.BigEndian.Uint64(b[2:]))
+	newLength := int(binary.BigEndian.Uint32(b[2+offsetSize:]))
+	newItemOffset := int64(binary.BigEndian.Uint64(b[2+offsetSize+lengthSize:]))
+	oldTailOffset := int64(binary.BigEndian.Uint64(b[2+offsetSize+lengthSize+offsetSize:]))
+	if err := s.shiftLiveRegion(oldTailOffset, newOffset-s.headSize); err != nil {
+		return err
+	}
+	s.offset = newOffset
+	s.tailOffset = s.headSize
+	s.length = newLength
+	s.itemOffset = newItemOffset
+	if err := s.writeHead(); err != nil {
+		return err
+	}
+	if err := s.storage.Truncate(s.offset); err != nil {
+		return err
+	}
+	return s.wal.Truncate(0)
+}
+
+// syncLocked fsyncs the WAL, if any, and the main storage. Caller must
+// hold s.lock.
+func (s *Stack) syncLocked() error {
+	if s.wal != nil {
+		if err := s.wal.Sync(); err != nil {
+			return err
+		}
+	}
+	return s.storage.Sync()
+}
+
+// Sync flushes the stack to stable storage. Useful as an explicit
+// durability checkpoint after a run of Puts made under SyncNone or
+// SyncBatch.
+func (s *Stack) Sync() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.syncLocked()
 }
 
 // writeHead writes the head.
 func (s *Stack) writeHead() (err error) {
-	b := make([]byte, 8+4)
-	binary.BigEndian.PutUint64(b, uint64(s.offset))
-	binary.BigEndian.PutUint32(b[8:], uint32(s.length))
-	if _, err = s.file.WriteAt(b, 0); err != nil {
+	if s.ringMode {
+		return s.writeRingHead()
+	}
+	if s.cipherAlgo != CipherNone {
+		return s.writeCipherHead(cipherMeta(s.cipherSalt, s.cipherKeyCheck))
+	}
+	if s.headSize == legacyHeadSize {
+		b := make([]byte, legacyHeadSize)
+		binary.BigEndian.PutUint64(b, uint64(s.offset))
+		binary.BigEndian.PutUint32(b[offsetSize:], uint32(s.length))
+		_, err = s.storage.WriteAt(b, 0)
+		return
+	}
+	b := make([]byte, newHeadSize)
+	b[0] = headVersionHash
+	b[1] = byte(s.algo)
+	binary.BigEndian.PutUint64(b[2:], uint64(s.offset))
+	binary.BigEndian.PutUint32(b[2+offsetSize:], uint32(s.length))
+	_, err = s.storage.WriteAt(b, 0)
+	return
+}
+
+// writeRingHead writes a version-3 (ring) head.
+func (s *Stack) writeRingHead() error {
+	b := make([]byte, ringHeadSize)
+	b[0] = headVersionRing
+	binary.BigEndian.PutUint64(b[2:], uint64(s.offset))
+	binary.BigEndian.PutUint32(b[2+offsetSize:], uint32(s.length))
+	binary.BigEndian.PutUint64(b[2+offsetSize+lengthSize:], uint64(s.tailOffset))
+	binary.BigEndian.PutUint64(b[2+offsetSize+lengthSize+offsetSize:], uint64(s.itemOffset))
+	_, err := s.storage.WriteAt(b, 0)
+	return err
+}
+
+// readRingHead reads a version-3 (ring) head.
+func (s *Stack) readRingHead() (err error) {
+	b := make([]byte, ringHeadSize)
+	if _, err = s.storage.ReadAt(b, 0); err != nil {
+		return
+	}
+	s.offset = int64(binary.BigEndian.Uint64(b[2:]))
+	s.length = int(binary.BigEndian.Uint32(b[2+offsetSize:]))
+	s.tailOffset = int64(binary.BigEndian.Uint64(b[2+offsetSize+lengthSize:]))
+	s.itemOffset = int64(binary.BigEndian.Uint64(b[2+offsetSize+lengthSize+offsetSize:]))
+	return nil
+}
+
+// DropOldest discards the n oldest records from the bottom of the stack.
+// It requires the stack to have been opened in ring mode
+// (TailDropPolicy: TailDropOldest) and returns ErrRingModeRequired
+// otherwise. n<=0 is a no-op, and it stops early once the stack empties.
+func (s *Stack) DropOldest(n int) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.ringMode {
+		return ErrRingModeRequired
+	}
+	if n <= 0 {
+		return nil
+	}
+	return s.dropOldestLocked(n)
+}
+
+// dropOldestLocked discards up to n records from the bottom of the
+// stack. Caller must hold s.lock and have already checked ring mode.
+func (s *Stack) dropOldestLocked(n int) (err error) {
+	for i := 0; i < n && s.length > 0; i++ {
+		b := make([]byte, 4)
+		if _, err = s.storage.ReadAt(b, s.tailOffset); err != nil { // leading size
+			return
+		}
+		size := int64(binary.BigEndian.Uint32(b))
+		s.tailOffset += 4 + size + 4
+		s.length--
+		s.itemOffset++
+	}
+	if s.tailOffset-s.headSize >= s.opts.FragmentsThreshold {
+		return s.commitCompactRing(s.tailOffset, s.length, s.itemOffset)
+	}
+	return s.commitHeadRing(s.offset, s.tailOffset, s.length, s.itemOffset)
+}
+
+// commitCompactRing durably reclaims the space freed by records already
+// dropped from the bottom, shifting the live region down from
+// oldTailOffset to headSize. Unlike commitHeadRing, the shift itself
+// moves bytes, so it can't simply follow intent-then-apply around a
+// pointer update: if the WAL intent were written only after the shift,
+// a crash in between would leave the still-untouched head pointing at a
+// tailOffset whose bytes may already have been overwritten by the
+// shift's destination write. Instead the intent is written and fsynced
+// before any byte moves, carrying oldTailOffset so replay can redo the
+// shift itself rather than merely trust it happened; shiftLiveRegion is
+// safe to call whether or not the shift (or the truncate after it)
+// already completed. The truncate that reclaims the space is
+// unconditional: compaction only ever shrinks the file, and must not be
+// blocked by Options.SizeLimit the way growth is.
+func (s *Stack) commitCompactRing(oldTailOffset int64, newLength int, newItemOffset int64) error {
+	liveSize := s.offset - oldTailOffset
+	newOffset := s.headSize + liveSize
+	if s.wal != nil {
+		if err := s.writeWALIntentCompactRing(newOffset, newLength, newItemOffset, oldTailOffset); err != nil {
+			return err
+		}
+	}
+	if err := s.shiftLiveRegion(oldTailOffset, liveSize); err != nil {
+		return err
+	}
+	s.offset = newOffset
+	s.tailOffset = s.headSize
+	s.length = newLength
+	s.itemOffset = newItemOffset
+	s.gen++
+	if err := s.writeHead(); err != nil {
+		return err
+	}
+	if err := s.storage.Truncate(s.offset); err != nil {
+		return err
+	}
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Truncate(0)
+}
+
+// shiftLiveRegion copies the liveSize live bytes starting at
+// oldTailOffset down to headSize. It's called both for a fresh
+// compaction and by replay redoing one after a crash, so it must be
+// safe to call twice: if the storage is already shorter than
+// oldTailOffset+liveSize, the shift (and the truncate that follows it)
+// already happened, and there is nothing left to read.
+func (s *Stack) shiftLiveRegion(oldTailOffset, liveSize int64) error {
+	size, err := s.storage.Size()
+	if err != nil {
+		return err
+	}
+	if size < oldTailOffset+liveSize {
+		return nil
+	}
+	buf := make([]byte, liveSize)
+	if _, err := s.storage.ReadAt(buf, oldTailOffset); err != nil {
 		return err
 	}
+	_, err = s.storage.WriteAt(buf, s.headSize)
+	return err
+}
+
+// Verify walks the stack from top to bottom verifying every record,
+// without mutating the stack. It stops at the first bad record it finds,
+// returning ErrChecksumMismatch for a checksum mismatch, ErrAuthFailed
+// for an encrypted record that fails to authenticate, or ErrFileInvalid
+// for a size field reaching below the live region. With HashNone and no
+// Cipher there is no per-record check, so Verify then fails only on such
+// a size field or an I/O error.
+func (s *Stack) Verify() error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, err := s.scan(false)
+	return err
+}
+
+// Scrub walks the whole stack the same way Verify does, but does not stop
+// at the first corrupted record: it keeps going and counts every bad
+// record it finds instead. The returned error is nil unless an
+// unrecoverable error (e.g. an I/O error) aborted the scan early; a
+// non-zero nBad with a nil error means the scan ran to completion and
+// found that many corrupted records.
+func (s *Stack) Scrub() (nBad int, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.scan(true)
+}
+
+// Iterator walks a Stack's records from top to bottom without popping
+// them. Obtain one with (*Stack).Iterator. An Iterator is invalidated by
+// any subsequent Put, Pop, Clear or DropOldest on the same Stack, even
+// from another goroutine; once invalidated, Next returns
+// ErrIterInvalidated instead of a possibly-inconsistent read.
+type Iterator struct {
+	s      *Stack
+	gen    int64
+	offset int64 // read position: the next record ends here
+}
+
+// Iterator returns a read-only cursor over the stack's current records,
+// starting at the top. It does not hold a lock for its lifetime; instead
+// it snapshots the stack's generation counter and Next re-checks it on
+// every call.
+func (s *Stack) Iterator() *Iterator {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return &Iterator{s: s, gen: s.gen, offset: s.offset}
+}
+
+// Next returns the next record below the iterator's current position, or
+// nil,nil once the bottom of the stack is reached. It returns
+// ErrIterInvalidated if the stack has been mutated since the iterator
+// was created or since the last Next call.
+func (it *Iterator) Next() (data []byte, err error) {
+	it.s.lock.RLock()
+	defer it.s.lock.RUnlock()
+	if it.s.gen != it.gen {
+		return nil, ErrIterInvalidated
+	}
+	var recSize int64
+	if data, recSize, err = it.s.recordAt(it.offset); err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil // reached the bottom
+	}
+	it.offset -= recSize
+	return data, nil
+}
+
+// Close releases the iterator. It is safe to call Close more than once;
+// Iterator holds no resources of its own, so Close never returns an
+// error.
+func (it *Iterator) Close() error {
 	return nil
 }
+
+// PeekN returns up to n records from the top of the stack without
+// popping them, stopping early if the stack has fewer than n records. It
+// returns ErrIterInvalidated if the stack is mutated concurrently.
+func (s *Stack) PeekN(n int) ([][]byte, error) {
+	it := s.Iterator()
+	defer it.Close()
+	items := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		data, err := it.Next()
+		if err != nil {
+			return items, err
+		}
+		if data == nil {
+			break
+		}
+		items = append(items, data)
+	}
+	return items, nil
+}
+
+// scan walks records from top to bottom verifying checksums. When
+// tolerant is true it keeps going after a mismatch, counting bad records
+// instead of stopping at the first one.
+func (s *Stack) scan(tolerant bool) (nBad int, err error) {
+	offset := s.offset
+	for offset >= s.tailOffset+4 {
+		var recSize int64
+		_, recSize, err = s.recordAt(offset)
+		if err != nil {
+			if (err == ErrChecksumMismatch || err == ErrAuthFailed) && tolerant {
+				nBad++
+				err = nil
+			} else {
+				return
+			}
+		}
+		if recSize == 0 {
+			err = ErrFileInvalid
+			return
+		}
+		offset -= recSize
+	}
+	err = nil
+	return
+}
@@ -4,11 +4,23 @@ package diskstack
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
 	"os"
 	"runtime"
 	"testing"
 )
 
+// newGCM builds an AES-GCM AEAD from a fixed all-zero key, for testing.
+func newGCM(t *testing.T) cipher.AEAD {
+	block, err := aes.NewCipher(make([]byte, 32))
+	Must(t, err == nil)
+	aead, err := cipher.NewGCM(block)
+	Must(t, err == nil)
+	return aead
+}
+
 // Must asserts the given value is True for testing.
 func Must(t *testing.T, v bool) {
 	if !v {
@@ -19,19 +31,20 @@ func Must(t *testing.T, v bool) {
 
 func TestOpenEmpty(t *testing.T) {
 	fileName := "stack.db"
-	s, err := Open(fileName)
+	s, err := Open(fileName, nil)
 	// Must open without errors
 	Must(t, err == nil)
 	Must(t, s != nil)
 	defer os.Remove(fileName)
 	info, err := os.Stat(fileName)
-	// Must be an empty file
-	Must(t, err == nil && info.Size() == 0)
+	// Must be a logically empty stack, holding just the written head.
+	Must(t, err == nil && info.Size() == legacyHeadSize)
+	Must(t, s.Len() == 0)
 }
 
 func TestReOpen(t *testing.T) {
 	fileName := "stack.db"
-	s, _ := Open(fileName)
+	s, _ := Open(fileName, nil)
 	defer os.Remove(fileName)
 	// Put one item.
 	data := []byte{1, 2, 3}
@@ -39,14 +52,14 @@ func TestReOpen(t *testing.T) {
 	// Close stack.
 	s.Close()
 	// Reopen.
-	s, _ = Open(fileName)
+	s, _ = Open(fileName, nil)
 	// Must offset be correct.
-	Must(t, s.offset == int64(len(data))+4+8)
+	Must(t, s.offset == legacyHeadSize+int64(len(data))+4)
 }
 
 func TestTopEmpty(t *testing.T) {
 	fileName := "stack.db"
-	s, _ := Open(fileName)
+	s, _ := Open(fileName, nil)
 	defer os.Remove(fileName)
 	data, err := s.Top()
 	// Must be nil,nil
@@ -58,7 +71,7 @@ func TestTopEmpty(t *testing.T) {
 
 func TestOperations(t *testing.T) {
 	fileName := "stack.db"
-	s, _ := Open(fileName)
+	s, _ := Open(fileName, nil)
 	defer os.Remove(fileName)
 	data1 := []byte{1, 2, 3, 4}
 	data2 := []byte{5, 6, 7, 8}
@@ -87,7 +100,7 @@ func TestOperations(t *testing.T) {
 
 func TestOperationsBetweenOpens(t *testing.T) {
 	fileName := "stack.db"
-	s, _ := Open(fileName)
+	s, _ := Open(fileName, nil)
 	defer os.Remove(fileName)
 	data1 := []byte{1, 2, 3, 4}
 	data2 := []byte{5, 6, 7, 8}
@@ -99,9 +112,9 @@ func TestOperationsBetweenOpens(t *testing.T) {
 	// Close.
 	s.Close()
 	// Reopen.
-	s, _ = Open(fileName)
+	s, _ = Open(fileName, nil)
 	// Must offset be correct.
-	Must(t, s.offset == 3*(int64(len(data1))+4+8))
+	Must(t, s.offset == legacyHeadSize+3*(int64(len(data1))+4))
 	// Pops should be correct.
 	data, err := s.Pop()
 	Must(t, err == nil && bytes.Compare(data, data3) == 0)
@@ -113,9 +126,251 @@ func TestOperationsBetweenOpens(t *testing.T) {
 	Must(t, err == nil && bytes.Compare(data, nil) == 0)
 }
 
+func TestChecksumVerify(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, &Options{HashAlgo: HashCRC32C})
+	defer os.Remove(fileName)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	// Must put ok.
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	// Must verify ok on an intact file.
+	Must(t, s.Verify() == nil)
+	// Top should detect a corrupted checksum.
+	corrupt := make([]byte, 1)
+	s.storage.ReadAt(corrupt, s.offset-5)
+	corrupt[0] ^= 0xff
+	s.storage.WriteAt(corrupt, s.offset-5)
+	_, err := s.Top()
+	Must(t, err == ErrChecksumMismatch)
+	// Scrub should count the bad record without stopping or failing.
+	nBad, err := s.Scrub()
+	Must(t, err == nil && nBad == 1)
+}
+
+func TestCipherOperations(t *testing.T) {
+	fileName := "stack.db"
+	defer os.Remove(fileName)
+	s, err := Open(fileName, &Options{Cipher: newGCM(t)})
+	Must(t, err == nil)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	// Top should be data2, decrypted.
+	data, err := s.Top()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	Must(t, s.Close() == nil)
+	// Reopening with the right key decrypts fine.
+	s, err = Open(fileName, &Options{Cipher: newGCM(t)})
+	Must(t, err == nil)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	Must(t, len(s.CipherSalt()) == cipherSaltSize)
+	Must(t, s.Close() == nil)
+	// Reopening with the wrong key is rejected at Open.
+	wrongBlock, _ := aes.NewCipher(append(make([]byte, 31), 1))
+	wrongAead, _ := cipher.NewGCM(wrongBlock)
+	_, err = Open(fileName, &Options{Cipher: wrongAead})
+	Must(t, err == ErrAuthFailed)
+}
+
+func TestRingMode(t *testing.T) {
+	fileName := "stack.db"
+	defer os.Remove(fileName)
+	s, err := Open(fileName, &Options{MaxRecords: 2, TailDropPolicy: TailDropOldest})
+	Must(t, err == nil)
+	// Putting a 3rd item should drop the oldest automatically.
+	Must(t, s.Put([]byte{1}) == nil)
+	Must(t, s.Put([]byte{2}) == nil)
+	Must(t, s.Put([]byte{3}) == nil)
+	Must(t, s.Len() == 2)
+	data, err := s.Top()
+	Must(t, err == nil && bytes.Compare(data, []byte{3}) == 0)
+	// An explicit DropOldest(1) should drop the older of the two left.
+	Must(t, s.DropOldest(1) == nil)
+	Must(t, s.Len() == 1)
+	data, err = s.Top()
+	Must(t, err == nil && bytes.Compare(data, []byte{3}) == 0)
+	Must(t, s.Close() == nil)
+	// Must reopen with the ring head intact.
+	s, err = Open(fileName, &Options{MaxRecords: 2, TailDropPolicy: TailDropOldest})
+	Must(t, err == nil && s.Len() == 1)
+	// Ring mode cannot be combined with HashAlgo or Cipher.
+	_, err = Open(fileName, &Options{HashAlgo: HashCRC32C, TailDropPolicy: TailDropOldest})
+	Must(t, err == ErrRingModeConflict)
+	// DropOldest on a non-ring stack is rejected.
+	plainFileName := "stack_plain.db"
+	defer os.Remove(plainFileName)
+	plain, _ := Open(plainFileName, nil)
+	Must(t, plain.DropOldest(1) == ErrRingModeRequired)
+}
+
+func TestRingModeSizeLimit(t *testing.T) {
+	fileName := "stack.db"
+	defer os.Remove(fileName)
+	// MaxRecords is large enough that SizeLimit, not the ring's own
+	// tail-drop, is what must stop growth.
+	s, err := Open(fileName, &Options{MaxRecords: 1000, TailDropPolicy: TailDropOldest, SizeLimit: 40})
+	Must(t, err == nil)
+	Must(t, s.Put([]byte{1, 2, 3, 4}) == nil)
+	Must(t, s.Put([]byte{1, 2, 3, 4}) == ErrSizeLimit)
+}
+
+func TestRingModeWALRecovery(t *testing.T) {
+	fileName := "stack.db"
+	walName := fileName + ".wal"
+	defer os.Remove(fileName)
+	defer os.Remove(walName)
+	s, err := Open(fileName, &Options{MaxRecords: 1, TailDropPolicy: TailDropOldest})
+	Must(t, err == nil)
+	Must(t, s.Put([]byte{1}) == nil)
+	// A file-backed ring stack must get a WAL too.
+	Must(t, s.wal != nil)
+	// DropOldest must go through the WAL: simulate a crash right after
+	// its ring intent is durable but before it's applied to the head.
+	preOffset, preItem := s.offset, s.itemOffset
+	Must(t, s.writeWALIntentRing(preOffset, preOffset, 0, preItem+1) == nil)
+	Must(t, s.Close() == nil)
+	s, err = Open(fileName, &Options{MaxRecords: 1, TailDropPolicy: TailDropOldest})
+	Must(t, err == nil && s.Len() == 0)
+	Must(t, s.tailOffset == preOffset && s.itemOffset == preItem+1)
+}
+
+func TestRingModeCompactionWALRecovery(t *testing.T) {
+	fileName := "stack.db"
+	walName := fileName + ".wal"
+	defer os.Remove(fileName)
+	defer os.Remove(walName)
+	s, err := Open(fileName, &Options{MaxRecords: 1000, TailDropPolicy: TailDropOldest, FragmentsThreshold: 1})
+	Must(t, err == nil)
+	Must(t, s.Put([]byte{1}) == nil)
+	Must(t, s.Put([]byte{2}) == nil)
+	Must(t, s.Put([]byte{3}) == nil)
+	Must(t, s.Put([]byte{4}) == nil)
+	// Advance past the bottom two records by hand, the way
+	// dropOldestLocked does, without actually compacting: this lets us
+	// simulate a crash right after the compaction intent is durable but
+	// before the live region has been shifted down to headSize.
+	for i := 0; i < 2; i++ {
+		b := make([]byte, 4)
+		_, err = s.storage.ReadAt(b, s.tailOffset)
+		Must(t, err == nil)
+		size := int64(binary.BigEndian.Uint32(b))
+		s.tailOffset += 4 + size + 4
+	}
+	liveSize := s.offset - s.tailOffset
+	newOffset := s.headSize + liveSize
+	Must(t, s.writeWALIntentCompactRing(newOffset, s.length-2, s.itemOffset+2, s.tailOffset) == nil)
+	// The intent is durable, but no bytes have moved and the on-disk head
+	// still claims 4 records rooted at the original tailOffset.
+	Must(t, s.Close() == nil)
+	s, err = Open(fileName, &Options{MaxRecords: 1000, TailDropPolicy: TailDropOldest, FragmentsThreshold: 1})
+	Must(t, err == nil && s.Len() == 2)
+	Must(t, s.tailOffset == s.headSize)
+	data, err := s.Top()
+	Must(t, err == nil && bytes.Compare(data, []byte{4}) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, []byte{4}) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, []byte{3}) == 0)
+}
+
+func TestOpenWithMemStorage(t *testing.T) {
+	s, err := OpenWith(NewMemStorage(), nil)
+	Must(t, err == nil)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	data, err := s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data1) == 0)
+	Must(t, s.Close() == nil)
+}
+
+func TestWALRecovery(t *testing.T) {
+	fileName := "stack.db"
+	walName := fileName + ".wal"
+	defer os.Remove(fileName)
+	defer os.Remove(walName)
+	s, err := Open(fileName, nil)
+	Must(t, err == nil)
+	data1 := []byte{1, 2, 3}
+	data2 := []byte{4, 5, 6, 7}
+	Must(t, s.Put(data1) == nil)
+	// A file-backed Stack must get a WAL automatically.
+	Must(t, s.wal != nil)
+	// Simulate a crash right after data2's payload and WAL intent are
+	// durable, but before the intent is applied to the head: the head
+	// must not see data2 yet, but the next Open should recover it.
+	buf := make([]byte, len(data2)+4)
+	copy(buf, data2)
+	binary.BigEndian.PutUint32(buf[len(data2):], uint32(len(data2)))
+	_, err = s.storage.WriteAt(buf, s.offset)
+	Must(t, err == nil)
+	Must(t, s.writeWALIntent(s.offset+int64(len(buf)), s.length+1) == nil)
+	Must(t, s.Close() == nil)
+	s, err = Open(fileName, nil)
+	Must(t, err == nil && s.Len() == 2)
+	data, err := s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data1) == 0)
+	// A torn intent (bad checksum) must be discarded, not replayed.
+	Must(t, s.Put(data1) == nil)
+	torn := make([]byte, walRecordSize)
+	torn[0] = walOpCommit
+	_, err = s.wal.WriteAt(torn, 0)
+	Must(t, err == nil)
+	Must(t, s.Close() == nil)
+	s, err = Open(fileName, nil)
+	Must(t, err == nil && s.Len() == 1)
+}
+
+func TestIterator(t *testing.T) {
+	fileName := "stack.db"
+	s, _ := Open(fileName, nil)
+	defer os.Remove(fileName)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	data3 := []byte{9, 10, 11, 12}
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	Must(t, s.Put(data3) == nil)
+	// Iterator must walk top to bottom without popping.
+	it := s.Iterator()
+	data, err := it.Next()
+	Must(t, err == nil && bytes.Compare(data, data3) == 0)
+	data, err = it.Next()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	data, err = it.Next()
+	Must(t, err == nil && bytes.Compare(data, data1) == 0)
+	data, err = it.Next()
+	Must(t, err == nil && data == nil)
+	Must(t, it.Close() == nil)
+	Must(t, s.Len() == 3)
+	// A concurrent Put must invalidate an in-flight iterator.
+	it = s.Iterator()
+	Must(t, s.Put([]byte{13}) == nil)
+	_, err = it.Next()
+	Must(t, err == ErrIterInvalidated)
+	// PeekN returns up to n records without popping.
+	items, err := s.PeekN(2)
+	Must(t, err == nil && len(items) == 2)
+	Must(t, bytes.Compare(items[0], []byte{13}) == 0)
+	Must(t, bytes.Compare(items[1], data3) == 0)
+	Must(t, s.Len() == 4)
+	// PeekN stops early if the stack has fewer than n records.
+	items, err = s.PeekN(10)
+	Must(t, err == nil && len(items) == 4)
+}
+
 func BenchmarkPut(b *testing.B) {
 	fileName := "stack.db"
-	s, _ := Open(fileName)
+	s, _ := Open(fileName, nil)
 	defer os.Remove(fileName)
 	data := []byte("12345678910")
 	b.ResetTimer()
@@ -127,7 +382,7 @@ func BenchmarkPut(b *testing.B) {
 
 func BenchmarkPutLargeItem(b *testing.B) {
 	fileName := "stack.db"
-	s, _ := Open(fileName)
+	s, _ := Open(fileName, nil)
 	defer os.Remove(fileName)
 	var data []byte
 	for i := 0; i < 1024; i++ {
@@ -142,7 +397,7 @@ func BenchmarkPutLargeItem(b *testing.B) {
 
 func BenchmarkPop(b *testing.B) {
 	fileName := "stack.db"
-	s, _ := Open(fileName)
+	s, _ := Open(fileName, nil)
 	defer os.Remove(fileName)
 	data := []byte("12345678910")
 	for i := 0; i < b.N; i++ {
@@ -157,7 +412,7 @@ func BenchmarkPop(b *testing.B) {
 
 func BenchmarkPopLargeItem(b *testing.B) {
 	fileName := "stack.db"
-	s, _ := Open(fileName)
+	s, _ := Open(fileName, nil)
 	defer os.Remove(fileName)
 	var data []byte
 	for i := 0; i < 1024; i++ {
@@ -0,0 +1,144 @@
+// Copyright 2016 Chao Wang <hit9@icloud.com>
+
+package diskstack
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage is the storage backend a Stack is built on top of. Any type
+// satisfying Storage can back a Stack: a plain file, an in-memory buffer
+// for tests, a memory-mapped file, or a stub over a remote object store.
+// Storage is expected to behave like a fixed-origin byte array that can
+// grow: offsets are always absolute from 0, and WriteAt past the current
+// end of storage is expected to extend it, like *os.File.
+type Storage interface {
+	// ReadAt reads len(p) bytes starting at offset off, like io.ReaderAt.
+	ReadAt(p []byte, off int64) (n int, err error)
+	// WriteAt writes len(p) bytes starting at offset off, like
+	// io.WriterAt, extending the storage if off+len(p) is past its
+	// current size.
+	WriteAt(p []byte, off int64) (n int, err error)
+	// Truncate changes the size of the storage.
+	Truncate(size int64) error
+	// Sync commits any buffered data to stable storage.
+	Sync() error
+	// Size returns the current size of the storage.
+	Size() (int64, error)
+	// Close releases any resources held by the storage.
+	Close() error
+}
+
+// WALCapable is implemented by Storage backends that can provide a
+// sidecar write-ahead log alongside their main storage, letting Stack
+// protect its head updates against a crash between a payload write and
+// the head write that makes it visible. fileStorage is the only
+// backend in this package that implements it; backends that don't
+// (memStorage, mmapStorage) simply run without that protection.
+type WALCapable interface {
+	// OpenWAL opens or creates this storage's write-ahead log.
+	OpenWAL() (Storage, error)
+}
+
+// fileStorage is the default Storage backend, backed by a plain *os.File.
+type fileStorage struct {
+	file *os.File
+	path string
+}
+
+// newFileStorage opens or creates the file at path as a fileStorage.
+func newFileStorage(path string) (*fileStorage, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+	return &fileStorage{file: file, path: path}, nil
+}
+
+// OpenWAL opens or creates the sidecar "<path>.wal" file next to f.
+func (f *fileStorage) OpenWAL() (Storage, error) {
+	return newFileStorage(f.path + ".wal")
+}
+
+func (f *fileStorage) ReadAt(p []byte, off int64) (int, error)  { return f.file.ReadAt(p, off) }
+func (f *fileStorage) WriteAt(p []byte, off int64) (int, error) { return f.file.WriteAt(p, off) }
+func (f *fileStorage) Truncate(size int64) error                { return f.file.Truncate(size) }
+func (f *fileStorage) Sync() error                              { return f.file.Sync() }
+func (f *fileStorage) Close() error                             { return f.file.Close() }
+
+func (f *fileStorage) Size() (int64, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// memStorage is an in-memory Storage backend, useful for tests that want
+// Stack's on-disk format without touching the filesystem.
+type memStorage struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// newMemStorage returns an empty memStorage.
+func newMemStorage() *memStorage {
+	return &memStorage{}
+}
+
+// NewMemStorage returns an empty in-memory Storage, for use with
+// OpenWith by callers who want Stack's on-disk format without touching
+// the filesystem, e.g. tests or short-lived stacks.
+func NewMemStorage() Storage {
+	return newMemStorage()
+}
+
+func (m *memStorage) ReadAt(p []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off < 0 || off > int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (m *memStorage) WriteAt(p []byte, off int64) (n int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	end := off + int64(len(p))
+	if end > int64(len(m.data)) {
+		grown := make([]byte, end)
+		copy(grown, m.data)
+		m.data = grown
+	}
+	return copy(m.data[off:end], p), nil
+}
+
+func (m *memStorage) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size <= int64(len(m.data)) {
+		m.data = m.data[:size]
+		return nil
+	}
+	grown := make([]byte, size)
+	copy(grown, m.data)
+	m.data = grown
+	return nil
+}
+
+func (m *memStorage) Sync() error { return nil }
+
+func (m *memStorage) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.data)), nil
+}
+
+func (m *memStorage) Close() error { return nil }
@@ -0,0 +1,125 @@
+// Copyright 2016 Chao Wang <hit9@icloud.com>
+
+//go:build unix
+
+package diskstack
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// mmapStorage memory-maps the underlying file for reads, falling back to
+// ordinary file I/O for writes and remapping the new extent in
+// afterwards. It suits read-heavy workloads, where most calls are
+// ReadAt, at the cost of a remap on every WriteAt/Truncate.
+type mmapStorage struct {
+	mu     sync.Mutex
+	file   *os.File
+	mapped []byte // nil when the file is empty
+}
+
+// newMmapStorage opens or creates the file at path as an mmapStorage.
+func newMmapStorage(path string) (*mmapStorage, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+	m := &mmapStorage{file: file}
+	if err := m.remap(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewMmapStorage opens or creates the file at path as a memory-mapped
+// Storage, for use with OpenWith by callers with read-heavy workloads.
+func NewMmapStorage(path string) (Storage, error) {
+	return newMmapStorage(path)
+}
+
+// remap drops the current mapping, if any, and maps the file's current
+// contents in again. Caller must hold m.mu.
+func (m *mmapStorage) remap() error {
+	if m.mapped != nil {
+		if err := syscall.Munmap(m.mapped); err != nil {
+			return err
+		}
+		m.mapped = nil
+	}
+	info, err := m.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	data, err := syscall.Mmap(int(m.file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.mapped = data
+	return nil
+}
+
+func (m *mmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mapped == nil || off < 0 || off+int64(len(p)) > int64(len(m.mapped)) {
+		return m.file.ReadAt(p, off)
+	}
+	return copy(p, m.mapped[off:]), nil
+}
+
+func (m *mmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := m.file.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	if err := m.remap(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (m *mmapStorage) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.file.Truncate(size); err != nil {
+		return err
+	}
+	return m.remap()
+}
+
+func (m *mmapStorage) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.Sync()
+}
+
+func (m *mmapStorage) Size() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, err := m.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (m *mmapStorage) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mapped != nil {
+		if err := syscall.Munmap(m.mapped); err != nil {
+			m.file.Close()
+			return err
+		}
+		m.mapped = nil
+	}
+	return m.file.Close()
+}
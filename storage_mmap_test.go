@@ -0,0 +1,31 @@
+// Copyright 2016 Chao Wang <hit9@icloud.com>
+
+//go:build unix
+
+package diskstack
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestOpenWithMmapStorage(t *testing.T) {
+	fileName := "stack_mmap.db"
+	defer os.Remove(fileName)
+	storage, err := NewMmapStorage(fileName)
+	Must(t, err == nil)
+	s, err := OpenWith(storage, nil)
+	Must(t, err == nil)
+	data1 := []byte{1, 2, 3, 4}
+	data2 := []byte{5, 6, 7, 8}
+	Must(t, s.Put(data1) == nil)
+	Must(t, s.Put(data2) == nil)
+	data, err := s.Top()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data2) == 0)
+	data, err = s.Pop()
+	Must(t, err == nil && bytes.Compare(data, data1) == 0)
+	Must(t, s.Close() == nil)
+}